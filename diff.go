@@ -0,0 +1,269 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DiffOptions configures how the primary and secondary responses of a
+// dualServer request are compared.
+type DiffOptions struct {
+	// IgnoreHeaders names headers (case-insensitive) excluded from
+	// the header comparison, e.g. Date, which differs on every call.
+	IgnoreHeaders map[string]bool
+	// JSONTolerance is the maximum absolute difference between two
+	// JSON numbers still considered equal.
+	JSONTolerance float64
+	// ArrayOrderInsensitive makes JSON array comparison ignore
+	// element order, matching elements by content instead of index;
+	// useful for APIs that don't guarantee array ordering.
+	ArrayOrderInsensitive bool
+}
+
+// NewDiffOptions builds a DiffOptions from the -diff-ignore-headers
+// (comma separated), -diff-json-tolerance and -diff-array-order-insensitive
+// flag values.
+func NewDiffOptions(ignoreHeaders string, jsonTolerance float64, arrayOrderInsensitive bool) DiffOptions {
+	ignore := make(map[string]bool)
+	for _, h := range strings.Split(ignoreHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			ignore[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return DiffOptions{IgnoreHeaders: ignore, JSONTolerance: jsonTolerance, ArrayOrderInsensitive: arrayOrderInsensitive}
+}
+
+// HeaderDiff is a single header whose value differs (or is
+// present/absent) between the primary and secondary responses.
+type HeaderDiff struct {
+	Name      string   `json:"name"`
+	Primary   []string `json:"primary,omitempty"`
+	Secondary []string `json:"secondary,omitempty"`
+}
+
+// FieldDiff is a single JSON field that was added, removed or changed.
+type FieldDiff struct {
+	Path      string      `json:"path"`
+	Op        string      `json:"op"` // "added", "removed" or "changed"
+	Primary   interface{} `json:"primary,omitempty"`
+	Secondary interface{} `json:"secondary,omitempty"`
+}
+
+// DiffReport is written as "{id}.diff.json" next to the .resp1/.resp2 dumps.
+type DiffReport struct {
+	StatusPrimary   int          `json:"status_primary"`
+	StatusSecondary int          `json:"status_secondary"`
+	Headers         []HeaderDiff `json:"headers,omitempty"`
+	BodyEqual       bool         `json:"body_equal"`
+	JSONFields      []FieldDiff  `json:"json_fields,omitempty"`
+}
+
+// Added, Removed and Changed count the JSONFields by Op, for the
+// one-line summary log.
+func (r *DiffReport) Added() (n int)   { return r.countOp("added") }
+func (r *DiffReport) Removed() (n int) { return r.countOp("removed") }
+func (r *DiffReport) Changed() (n int) { return r.countOp("changed") }
+
+func (r *DiffReport) countOp(op string) int {
+	n := 0
+	for _, f := range r.JSONFields {
+		if f.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// CompareResponses builds the DiffReport for a primary/secondary
+// response pair. body1/body2 are the already fully-read response
+// bodies.
+func CompareResponses(status1 int, header1 http.Header, body1 []byte, status2 int, header2 http.Header, body2 []byte, opts DiffOptions) *DiffReport {
+	report := &DiffReport{
+		StatusPrimary:   status1,
+		StatusSecondary: status2,
+		Headers:         diffHeaders(header1, header2, opts.IgnoreHeaders),
+		BodyEqual:       bytes.Equal(body1, body2),
+	}
+	ct := header1.Get("Content-Type")
+	if ct == "" {
+		ct = header2.Get("Content-Type")
+	}
+	if !report.BodyEqual && isJSON(ct) {
+		dbody1, derr1 := decompressBody(header1.Get("Content-Encoding"), body1)
+		dbody2, derr2 := decompressBody(header2.Get("Content-Encoding"), body2)
+		if derr1 == nil && derr2 == nil {
+			var v1, v2 interface{}
+			if err1, err2 := json.Unmarshal(dbody1, &v1), json.Unmarshal(dbody2, &v2); err1 == nil && err2 == nil {
+				report.JSONFields = diffJSON("", v1, v2, opts)
+			}
+		}
+	}
+	return report
+}
+
+func isJSON(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+func diffHeaders(h1, h2 http.Header, ignore map[string]bool) []HeaderDiff {
+	names := make(map[string]bool)
+	for k := range h1 {
+		names[k] = true
+	}
+	for k := range h2 {
+		names[k] = true
+	}
+	var diffs []HeaderDiff
+	var sorted []string
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		if ignore[k] {
+			continue
+		}
+		v1, v2 := h1[k], h2[k]
+		if !equalStrings(v1, v2) {
+			diffs = append(diffs, HeaderDiff{Name: k, Primary: v1, Secondary: v2})
+		}
+	}
+	return diffs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffJSON recursively compares v1 and v2, returning one FieldDiff
+// per added/removed/changed leaf or object key. Object keys are
+// compared order-insensitively (Go maps already have no order);
+// arrays are compared index-by-index, unless opts.ArrayOrderInsensitive
+// is set, in which case both arrays are sorted by their JSON
+// representation first so elements are matched by content.
+func diffJSON(path string, v1, v2 interface{}, opts DiffOptions) []FieldDiff {
+	switch a := v1.(type) {
+	case map[string]interface{}:
+		b, ok := a2map(v2)
+		if !ok {
+			return []FieldDiff{{Path: path, Op: "changed", Primary: v1, Secondary: v2}}
+		}
+		var diffs []FieldDiff
+		var keys []string
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			av, aok := a[k]
+			bv, bok := b[k]
+			switch {
+			case aok && !bok:
+				diffs = append(diffs, FieldDiff{Path: p, Op: "removed", Primary: av})
+			case !aok && bok:
+				diffs = append(diffs, FieldDiff{Path: p, Op: "added", Secondary: bv})
+			default:
+				diffs = append(diffs, diffJSON(p, av, bv, opts)...)
+			}
+		}
+		return diffs
+	case []interface{}:
+		b, ok := v2.([]interface{})
+		if !ok {
+			return []FieldDiff{{Path: path, Op: "changed", Primary: v1, Secondary: v2}}
+		}
+		if opts.ArrayOrderInsensitive {
+			a, b = sortJSONArray(a), sortJSONArray(b)
+		}
+		var diffs []FieldDiff
+		n := len(a)
+		if len(b) > n {
+			n = len(b)
+		}
+		for i := 0; i < n; i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(a):
+				diffs = append(diffs, FieldDiff{Path: p, Op: "added", Secondary: b[i]})
+			case i >= len(b):
+				diffs = append(diffs, FieldDiff{Path: p, Op: "removed", Primary: a[i]})
+			default:
+				diffs = append(diffs, diffJSON(p, a[i], b[i], opts)...)
+			}
+		}
+		return diffs
+	case float64:
+		b, ok := v2.(float64)
+		if !ok || math.Abs(a-b) > opts.JSONTolerance {
+			return []FieldDiff{{Path: path, Op: "changed", Primary: v1, Secondary: v2}}
+		}
+		return nil
+	default:
+		if v1 != v2 {
+			return []FieldDiff{{Path: path, Op: "changed", Primary: v1, Secondary: v2}}
+		}
+		return nil
+	}
+}
+
+func a2map(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	return m, ok
+}
+
+// sortJSONArray returns a copy of a sorted by each element's JSON
+// encoding, giving ArrayOrderInsensitive a stable way to line up
+// elements that carry the same content in a different order.
+func sortJSONArray(a []interface{}) []interface{} {
+	sorted := make([]interface{}, len(a))
+	copy(sorted, a)
+	sort.Slice(sorted, func(i, j int) bool {
+		return jsonSortKey(sorted[i]) < jsonSortKey(sorted[j])
+	})
+	return sorted
+}
+
+func jsonSortKey(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
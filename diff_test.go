@@ -0,0 +1,101 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+)
+
+func TestDiffHeaders(t *testing.T) {
+	ignore := map[string]bool{"Date": true}
+	h1 := http.Header{"Date": {"now"}, "X-Foo": {"a"}}
+	h2 := http.Header{"Date": {"later"}, "X-Foo": {"b"}}
+
+	diffs := diffHeaders(h1, h2, ignore)
+	if len(diffs) != 1 || diffs[0].Name != "X-Foo" {
+		t.Fatalf("want a single X-Foo diff, got %+v", diffs)
+	}
+}
+
+func TestCompareResponsesJSONTolerance(t *testing.T) {
+	h := http.Header{"Content-Type": {"application/json"}}
+	body1 := []byte(`{"n":1.0,"s":"same"}`)
+	body2 := []byte(`{"n":1.0004,"s":"same"}`)
+
+	withinTolerance := CompareResponses(200, h, body1, 200, h, body2, DiffOptions{JSONTolerance: 0.001})
+	if len(withinTolerance.JSONFields) != 0 {
+		t.Fatalf("expected no diffs within tolerance, got %+v", withinTolerance.JSONFields)
+	}
+
+	outsideTolerance := CompareResponses(200, h, body1, 200, h, body2, DiffOptions{JSONTolerance: 0})
+	if len(outsideTolerance.JSONFields) != 1 || outsideTolerance.JSONFields[0].Op != "changed" {
+		t.Fatalf("expected one changed field, got %+v", outsideTolerance.JSONFields)
+	}
+}
+
+func TestCompareResponsesCounts(t *testing.T) {
+	h := http.Header{"Content-Type": {"application/json"}}
+	body1 := []byte(`{"keep":1,"drop":2,"change":3}`)
+	body2 := []byte(`{"keep":1,"change":4,"add":5}`)
+
+	report := CompareResponses(200, h, body1, 200, h, body2, DiffOptions{})
+	if report.Added() != 1 || report.Removed() != 1 || report.Changed() != 1 {
+		t.Fatalf("want 1 added, 1 removed, 1 changed, got added=%d removed=%d changed=%d",
+			report.Added(), report.Removed(), report.Changed())
+	}
+}
+
+func TestCompareResponsesDecompressesBeforeDiffing(t *testing.T) {
+	gzipBody := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	h1 := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	h2 := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	body1 := gzipBody(`{"a":1}`)
+	body2 := gzipBody(`{"a":2}`)
+
+	report := CompareResponses(200, h1, body1, 200, h2, body2, DiffOptions{})
+	if len(report.JSONFields) != 1 || report.JSONFields[0].Path != "a" {
+		t.Fatalf("want a single diff on field \"a\", got %+v", report.JSONFields)
+	}
+}
+
+func TestCompareResponsesArrayOrderInsensitive(t *testing.T) {
+	h := http.Header{"Content-Type": {"application/json"}}
+	body1 := []byte(`{"items":[1,2,3]}`)
+	body2 := []byte(`{"items":[3,1,2]}`)
+
+	orderSensitive := CompareResponses(200, h, body1, 200, h, body2, DiffOptions{})
+	if len(orderSensitive.JSONFields) == 0 {
+		t.Fatalf("expected order-sensitive comparison to report diffs, got none")
+	}
+
+	orderInsensitive := CompareResponses(200, h, body1, 200, h, body2, DiffOptions{ArrayOrderInsensitive: true})
+	if len(orderInsensitive.JSONFields) != 0 {
+		t.Fatalf("expected no diffs once array order is ignored, got %+v", orderInsensitive.JSONFields)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// IsGRPC reports whether contentType names a gRPC payload
+// ("application/grpc", "application/grpc+proto", "application/grpc-web", ...).
+func IsGRPC(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.HasPrefix(strings.TrimSpace(contentType), "application/grpc")
+}
+
+// GRPCFrame is one length-prefixed gRPC message: a 1-byte compressed
+// flag followed by a 4-byte big-endian length and that many bytes of
+// (possibly compressed) protobuf.
+type GRPCFrame struct {
+	Compressed bool
+	Data       []byte
+}
+
+// SplitGRPCFrames parses body as a sequence of length-prefixed gRPC
+// messages, per the wire format in the gRPC-over-HTTP2 spec.
+func SplitGRPCFrames(body []byte) ([]GRPCFrame, error) {
+	var frames []GRPCFrame
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return frames, fmt.Errorf("truncated grpc frame header: %d bytes left", len(body))
+		}
+		compressed := body[0] != 0
+		length := binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint32(len(body)) < length {
+			return frames, fmt.Errorf("truncated grpc frame: want %d bytes, have %d", length, len(body))
+		}
+		frames = append(frames, GRPCFrame{Compressed: compressed, Data: body[:length]})
+		body = body[length:]
+	}
+	return frames, nil
+}
+
+// grpcFrameMeta is one entry of a grpcManifest.
+type grpcFrameMeta struct {
+	Index      int    `json:"index"`
+	Compressed bool   `json:"compressed"`
+	Length     int    `json:"length"`
+	Path       string `json:"path"`
+}
+
+// grpcManifest is written as "{key}.grpc.json" alongside the
+// "{key}.frameNN.bin" files it describes.
+type grpcManifest struct {
+	Frames      []grpcFrameMeta     `json:"frames"`
+	Trailer     map[string][]string `json:"trailer,omitempty"`
+	GRPCStatus  string              `json:"grpc_status,omitempty"`
+	GRPCMessage string              `json:"grpc_message,omitempty"`
+}
+
+// saveGRPCFrames splits body into gRPC frames and writes each as
+// "{key}.frameNN.bin" plus a "{key}.grpc.json" manifest recording
+// compressed-flag, length, and the trailers, for gRPC/HTTP2 traffic
+// that the plain "{key}" dump would otherwise mangle.
+func saveGRPCFrames(store Store, key string, body []byte, trailer http.Header) error {
+	frames, err := SplitGRPCFrames(body)
+	if err != nil {
+		return err
+	}
+	manifest := grpcManifest{
+		Trailer:     map[string][]string(trailer),
+		GRPCStatus:  trailer.Get("Grpc-Status"),
+		GRPCMessage: trailer.Get("Grpc-Message"),
+	}
+	for i, f := range frames {
+		framePath := fmt.Sprintf("%s.frame%02d.bin", key, i)
+		if err := store.Put(context.Background(), framePath, bytes.NewReader(f.Data)); err != nil {
+			return err
+		}
+		manifest.Frames = append(manifest.Frames, grpcFrameMeta{
+			Index:      i,
+			Compressed: f.Compressed,
+			Length:     len(f.Data),
+			Path:       framePath,
+		})
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return store.Put(context.Background(), key+".grpc.json", bytes.NewReader(b))
+}
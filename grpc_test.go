@@ -0,0 +1,82 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import "testing"
+
+func TestIsGRPC(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"application/grpc-web", true},
+		{"application/grpc; charset=utf-8", true},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := IsGRPC(c.contentType); got != c.want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", c.contentType, got, c.want)
+		}
+	}
+}
+
+func frame(compressed bool, data []byte) []byte {
+	b := make([]byte, 5+len(data))
+	if compressed {
+		b[0] = 1
+	}
+	b[1] = byte(len(data) >> 24)
+	b[2] = byte(len(data) >> 16)
+	b[3] = byte(len(data) >> 8)
+	b[4] = byte(len(data))
+	copy(b[5:], data)
+	return b
+}
+
+func TestSplitGRPCFrames(t *testing.T) {
+	body := append(frame(false, []byte("hello")), frame(true, []byte("world!"))...)
+
+	frames, err := SplitGRPCFrames(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("want 2 frames, got %d", len(frames))
+	}
+	if frames[0].Compressed || string(frames[0].Data) != "hello" {
+		t.Errorf("frame 0 = %+v, want uncompressed %q", frames[0], "hello")
+	}
+	if !frames[1].Compressed || string(frames[1].Data) != "world!" {
+		t.Errorf("frame 1 = %+v, want compressed %q", frames[1], "world!")
+	}
+}
+
+func TestSplitGRPCFramesTruncatedHeader(t *testing.T) {
+	_, err := SplitGRPCFrames([]byte{0, 0, 0})
+	if err == nil {
+		t.Fatal("want an error for a truncated frame header, got nil")
+	}
+}
+
+func TestSplitGRPCFramesTruncatedBody(t *testing.T) {
+	full := frame(false, []byte("hello"))
+	_, err := SplitGRPCFrames(full[:len(full)-2])
+	if err == nil {
+		t.Fatal("want an error for a truncated frame body, got nil")
+	}
+}
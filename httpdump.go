@@ -1,4 +1,5 @@
-// This file is a copy of https://github.com/elazarl/goproxy/raw/7875f0f4ac5b4f810c20ed67fe6b987f93b84526/examples/goproxy-httpdump/httpdump.go
+// This file began as a copy of https://github.com/elazarl/goproxy/raw/7875f0f4ac5b4f810c20ed67fe6b987f93b84526/examples/goproxy-httpdump/httpdump.go,
+// trimmed to the Meta/stoppableListener pieces dualServer still uses.
 //
 // Copyright (c) 2012 Elazar Leibovich. All rights reserved.
 //
@@ -31,49 +32,18 @@
 package main
 
 import (
-	"errors"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
-	"path"
 	"sync"
 	"time"
-
-	"gopkg.in/elazarl/goproxy.v1"
-	"gopkg.in/elazarl/goproxy.v1/transport"
 )
 
-type FileStream struct {
-	path string
-	f    *os.File
-}
-
-func NewFileStream(path string) *FileStream {
-	return &FileStream{path, nil}
-}
-
-func (fs *FileStream) Write(b []byte) (nr int, err error) {
-	if fs.f == nil {
-		fs.f, err = os.Create(fs.path)
-		if err != nil {
-			return 0, err
-		}
-	}
-	return fs.f.Write(b)
-}
-
-func (fs *FileStream) Close() error {
-	fmt.Println("Close", fs.path)
-	if fs.f == nil {
-		return errors.New("FileStream was never written into")
-	}
-	return fs.f.Close()
-}
-
 type Meta struct {
 	req      *http.Request
 	resp     *http.Response
@@ -81,6 +51,8 @@ type Meta struct {
 	t        time.Time
 	sess     int64
 	bodyPath string
+	body     []byte
+	took     time.Duration
 	from     string
 }
 
@@ -111,6 +83,9 @@ func (m *Meta) WriteTo(w io.Writer) (nr int64, err error) {
 	fprintf(&nr, &err, w, "ReceivedAt: %v\r\n", m.t)
 	fprintf(&nr, &err, w, "Session: %d\r\n", m.sess)
 	fprintf(&nr, &err, w, "From: %v\r\n", m.from)
+	if m.took > 0 {
+		fprintf(&nr, &err, w, "Took: %v\r\n", m.took)
+	}
 	if m.err != nil {
 		// note the empty response
 		fprintf(&nr, &err, w, "Error: %v\r\n\r\n\r\n\r\n", m.err)
@@ -132,99 +107,47 @@ func (m *Meta) WriteTo(w io.Writer) (nr int64, err error) {
 	return
 }
 
-type HttpLogger struct {
-	path  string
-	c     chan *Meta
-	errch chan error
-}
-
-func NewLogger(basepath string) (*HttpLogger, error) {
-	f, err := os.Create(path.Join(basepath, "log"))
-	if err != nil {
-		return nil, err
-	}
-	logger := &HttpLogger{basepath, make(chan *Meta), make(chan error)}
-	go func() {
-		for m := range logger.c {
-			if _, err := m.WriteTo(f); err != nil {
-				log.Println("Can't write meta", err)
-			}
-		}
-		logger.errch <- f.Close()
-	}()
-	return logger, nil
-}
-
-func (logger *HttpLogger) LogResp(resp *http.Response, ctx *goproxy.ProxyCtx) {
-	body := path.Join(logger.path, fmt.Sprintf("%d_resp", ctx.Session))
-	from := ""
-	if ctx.UserData != nil {
-		from = ctx.UserData.(*transport.RoundTripDetails).TCPAddr.String()
+// WriteNDJSON renders m as one JSON line. It is the FormatNDJSON
+// counterpart of WriteTo.
+func (m *Meta) WriteNDJSON(w io.Writer) error {
+	rec := &ndjsonRecord{
+		ReceivedAt: m.t.Format(time.RFC3339Nano),
+		Session:    m.sess,
+		From:       m.from,
+		TookMS:     float64(m.took) / float64(time.Millisecond),
 	}
-	if resp == nil {
-		resp = emptyResp
-	} else {
-		resp.Body = NewTeeReadCloser(resp.Body, NewFileStream(body))
-	}
-	logger.LogMeta(&Meta{
-		resp: resp,
-		err:  ctx.Error,
-		t:    time.Now(),
-		sess: ctx.Session,
-		from: from})
-}
-
-var emptyResp = &http.Response{}
-var emptyReq = &http.Request{}
-
-func (logger *HttpLogger) LogReq(req *http.Request, ctx *goproxy.ProxyCtx) {
-	body := path.Join(logger.path, fmt.Sprintf("%d_req", ctx.Session))
-	if req == nil {
-		req = emptyReq
-	} else {
-		req.Body = NewTeeReadCloser(req.Body, NewFileStream(body))
+	if m.err != nil {
+		rec.Error = m.err.Error()
 	}
-	logger.LogMeta(&Meta{
-		req:  req,
-		err:  ctx.Error,
-		t:    time.Now(),
-		sess: ctx.Session,
-		from: req.RemoteAddr})
-}
-
-func (logger *HttpLogger) LogMeta(m *Meta) {
-	logger.c <- m
-}
-
-func (logger *HttpLogger) Close() error {
-	close(logger.c)
-	return <-logger.errch
-}
-
-type TeeReadCloser struct {
-	r io.Reader
-	w io.WriteCloser
-	c io.Closer
-}
-
-func NewTeeReadCloser(r io.ReadCloser, w io.WriteCloser) io.ReadCloser {
-	return &TeeReadCloser{io.TeeReader(r, w), w, r}
-}
-
-func (t *TeeReadCloser) Read(b []byte) (int, error) {
-	return t.r.Read(b)
-}
-
-func (t *TeeReadCloser) Close() error {
-	err1 := t.c.Close()
-	err2 := t.w.Close()
-	if err1 == nil && err2 == nil {
+	var header http.Header
+	switch {
+	case m.req != nil:
+		rec.Type = "request"
+		rec.Method = m.req.Method
+		if m.req.URL != nil {
+			rec.URL = m.req.URL.String()
+		}
+		header = m.req.Header
+	case m.resp != nil:
+		rec.Type = "response"
+		rec.Status = m.resp.StatusCode
+		header = m.resp.Header
+	default:
 		return nil
 	}
-	if err1 != nil {
-		return err2
+	rec.Header = map[string][]string(header)
+	if len(m.body) > 0 {
+		sum := sha256.Sum256(m.body)
+		rec.BodySHA256 = hex.EncodeToString(sum[:])
+		rec.BodyPath = m.bodyPath
+		if len(m.body) <= maxInlineBody {
+			rec.BodyInline = base64.StdEncoding.EncodeToString(m.body)
+		}
+		if decoded := decodeBody(header.Get("Content-Type"), header.Get("Content-Encoding"), m.body); decoded != nil {
+			rec.BodyDecoded = decoded
+		}
 	}
-	return err1
+	return writeNDJSON(w, rec)
 }
 
 type stoppableListener struct {
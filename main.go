@@ -16,17 +16,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -38,7 +46,20 @@ func main() {
 
 	flagVerbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
 	flagHTTP := flag.String("http", ":8080", "on which address should the proxy listen")
-	flagDir := flag.String("dir", "reqlog", "directory to log requests into")
+	flagDir := flag.String("dir", "reqlog", "directory (or, for -store=s3, bucket[/prefix]) to log requests into")
+	flagStore := flag.String("store", "file", "storage backend for captured dumps: file, s3, archive")
+	flagFormat := flag.String("format", "text", "log format for the per-session request/response trail written to the store's \"log\" key: text or ndjson")
+	flagDiffIgnoreHeaders := flag.String("diff-ignore-headers", "Date,Server,X-Request-Id", "comma separated headers excluded from the primary/secondary diff")
+	flagDiffJSONTolerance := flag.Float64("diff-json-tolerance", 0, "absolute tolerance for JSON number comparison in the primary/secondary diff")
+	flagDiffArrayOrderInsensitive := flag.Bool("diff-array-order-insensitive", false, "ignore JSON array element order in the primary/secondary diff")
+	flagCACert := flag.String("ca-cert", "", "root CA certificate (PEM) for MITM-ing CONNECT requests; generated and cached here if missing (default: <dir>/ca-cert.pem)")
+	flagCAKey := flag.String("ca-key", "", "root CA private key (PEM) matching -ca-cert (default: <dir>/ca-key.pem)")
+	flagMITMHosts := flag.String("mitm-hosts", "", "comma separated glob patterns of CONNECT hosts to MITM, prefix with ! to deny; empty MITMs every host")
+	flagMode := flag.String("mode", "proxy", "proxy (run the dual-server) or replay (reissue dumps from -dir/-store against -replay-target)")
+	flagReplayTarget := flag.String("replay-target", "", "base URL (scheme://host[:port]) requests are rewritten to and reissued against in -mode=replay")
+	flagReplayConcurrency := flag.Int("replay-concurrency", 4, "number of in-flight requests during -mode=replay")
+	flagReplayRate := flag.Float64("replay-rate", 0, "max requests/sec during -mode=replay; 0 means unlimited")
+	flagReplayPreserveTiming := flag.Bool("replay-preserve-timing", false, "space out -mode=replay requests by the gaps between their original Date headers, where present")
 	flag.Parse()
 
 	if !*flagVerbose {
@@ -46,10 +67,46 @@ func main() {
 		Log.SetHandler(hndl)
 	}
 
-	if err := os.MkdirAll(*flagDir, 0755); err != nil {
-		Log.Crit("Can't create dir", "path", *flagDir, "error", err)
+	store, err := NewStore(*flagStore, *flagDir, *flagDir)
+	if err != nil {
+		Log.Crit("Can't open store", "kind", *flagStore, "dir", *flagDir, "error", err)
+		os.Exit(1)
+	}
+	format, err := ParseDumpFormat(*flagFormat)
+	if err != nil {
+		Log.Crit("Can't parse -format", "error", err)
 		os.Exit(1)
 	}
+
+	if *flagMode == "replay" {
+		if *flagReplayTarget == "" {
+			Log.Crit("-mode=replay needs -replay-target")
+			os.Exit(1)
+		}
+		diffOpts := NewDiffOptions(*flagDiffIgnoreHeaders, *flagDiffJSONTolerance, *flagDiffArrayOrderInsensitive)
+		results, err := Replay(store, *flagReplayTarget, ReplayOptions{
+			Concurrency:    *flagReplayConcurrency,
+			RatePerSecond:  *flagReplayRate,
+			PreserveTiming: *flagReplayPreserveTiming,
+			DiffOpts:       diffOpts,
+		})
+		if err != nil {
+			Log.Crit("replay", "error", err)
+			os.Exit(1)
+		}
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				failed++
+				Log.Error("replay request", "key", r.ReqKey, "error", r.Err)
+			} else {
+				Log.Info("replay request", "key", r.ReqKey, "status", r.Status)
+			}
+		}
+		Log.Info("replay done", "total", len(results), "failed", failed)
+		return
+	}
+
 	l, err := net.Listen("tcp", *flagHTTP)
 	if err != nil {
 		Log.Crit("Listen", "address", *flagHTTP, "error", err)
@@ -64,9 +121,30 @@ func main() {
 		sl.Close()
 		sl.Done()
 	}()
+	diffOpts := NewDiffOptions(*flagDiffIgnoreHeaders, *flagDiffJSONTolerance, *flagDiffArrayOrderInsensitive)
+
+	caCert, caKey := *flagCACert, *flagCAKey
+	if caCert == "" {
+		caCert = filepath.Join(*flagDir, "ca-cert.pem")
+	}
+	if caKey == "" {
+		caKey = filepath.Join(*flagDir, "ca-key.pem")
+	}
+	ca, err := LoadOrCreateCA(caCert, caKey)
+	if err != nil {
+		Log.Crit("Can't load/create MITM CA", "cert", caCert, "key", caKey, "error", err)
+		os.Exit(1)
+	}
+	certCache := NewCertCache(ca)
+	mitmHosts := NewHostFilter(*flagMITMHosts)
+
+	ds := newDualServer(store, flag.Arg(0), flag.Arg(1), diffOpts, certCache, mitmHosts, format)
 	Log.Info("Starting Proxy, listening on " + *flagHTTP)
-	http.Serve(sl, newDualServer(*flagDir, flag.Arg(0), flag.Arg(1)))
+	http.Serve(sl, h2c.NewHandler(ds, &http2.Server{}))
 	sl.Wait()
+	if err := ds.log.w.Close(); err != nil {
+		Log.Error("close log", "error", err)
+	}
 	Log.Info("All connections closed - exit")
 }
 
@@ -74,150 +152,357 @@ var _ = http.Handler(&dualServer{})
 
 type dualServer struct {
 	primary, secondary *http.Client
-	dir                string
+	store              Store
+	diffOpts           DiffOptions
+	certCache          *CertCache
+	mitmHosts          *HostFilter
+	log                *dumpLog
 	id                 uint32
 }
 
 var timeout = 5 * time.Minute
 
-func newDualServer(dir, primary, secondary string) *dualServer {
+func newDualServer(store Store, primary, secondary string, diffOpts DiffOptions, certCache *CertCache, mitmHosts *HostFilter, format DumpFormat) *dualServer {
 	tr := http.Transport{MaxIdleConnsPerHost: 4, ResponseHeaderTimeout: 30 * time.Second}
+	if err := http2.ConfigureTransport(&tr); err != nil {
+		// HTTP/2 is an optimization for gRPC/h2 backends, not a
+		// requirement: fall back to HTTP/1.1-only on failure.
+		Log.Warn("can't configure HTTP/2 transport", "error", err)
+	}
 	return &dualServer{
-		dir:       dir,
+		store:     store,
+		diffOpts:  diffOpts,
+		certCache: certCache,
+		mitmHosts: mitmHosts,
+		log:       newDumpLog(store, format),
 		primary:   &http.Client{Timeout: timeout, Transport: &tr},
 		secondary: &http.Client{Timeout: timeout, Transport: &tr},
 	}
 }
 
+// dumpLog serializes one Meta record per captured request/response
+// into the store's "log" key, rendered in -format's DumpFormat; it is
+// dualServer's own capture path's counterpart of httpdump.go's Meta
+// text/NDJSON rendering, since dualServer drives its own ServeHTTP
+// loop rather than goproxy's.
+type dumpLog struct {
+	format DumpFormat
+	mu     sync.Mutex
+	w      io.WriteCloser
+}
+
+func newDumpLog(store Store, format DumpFormat) *dumpLog {
+	return &dumpLog{format: format, w: store.NewWriter("log")}
+}
+
+func (l *dumpLog) record(m *Meta) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if l.format == FormatNDJSON {
+		err = m.WriteNDJSON(l.w)
+	} else {
+		_, err = m.WriteTo(l.w)
+	}
+	if err != nil {
+		Log.Error("write log meta", "error", err)
+	}
+}
+
 func (ds *dualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// TODO(tgulacsi): save just the headers and return a TeeWriter body.
-	readReq, saveResp, err := ds.saveRequestResponse(r)
+	if r.Method == http.MethodConnect {
+		ds.handleConnect(w, r)
+		return
+	}
+
+	resp, err := ds.forward(r)
 	if err != nil {
-		Log.Crit("error saving request", "error", err)
-		http.Error(w, fmt.Sprintf("error saving request: %v", err), http.StatusInternalServerError)
+		Log.Error("forward", "error", err)
+		http.Error(w, fmt.Sprintf("forward: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if r, err = readReq(); err != nil {
-		Log.Error("error reading request", "error", err)
-		http.Error(w, fmt.Sprintf("error reading request: %v", err), http.StatusInternalServerError)
+	// answer
+	h := w.Header()
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		Log.Error("writing response", "error", err)
+	}
+}
+
+// handleConnect serves a CONNECT request, either by MITM-ing the
+// tunnel (terminating TLS with a cert minted for the SNI and
+// re-dispatching the decrypted requests through forward) or, for
+// hosts ds.mitmHosts excludes, by tunneling the raw bytes untouched.
+func (ds *dualServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Host
+	hostOnly := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostOnly = h
+	}
+	if ds.certCache == nil || (ds.mitmHosts != nil && !ds.mitmHosts.ShouldIntercept(hostOnly)) {
+		ds.tunnel(w, host)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		Log.Error("hijack", "error", err)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		Log.Error("write connection established", "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{GetConfigForClient: ds.certCache.GetConfigForClient})
+	defer tlsConn.Close()
+	if err := tlsConn.Handshake(); err != nil {
+		Log.Error("tls handshake", "host", host, "error", err)
 		return
 	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		ds.serveMITMH2(tlsConn, host)
+		return
+	}
+
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				Log.Error("read mitm'd request", "host", host, "error", err)
+			}
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+
+		resp, err := ds.forward(req)
+		if err != nil {
+			Log.Error("forward mitm'd request", "host", host, "error", err)
+			return
+		}
+		if err = resp.Write(tlsConn); err != nil {
+			Log.Error("write mitm'd response", "host", host, "error", err)
+			return
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+// serveMITMH2 serves an h2-negotiated MITM'd connection (the path
+// gRPC-over-TLS clients take), dispatching every stream through the
+// same forward/capture/diff logic as the HTTP/1.1 loop in
+// handleConnect.
+func (ds *dualServer) serveMITMH2(tlsConn *tls.Conn, host string) {
+	(&http2.Server{}).ServeConn(tlsConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = host
+
+			resp, err := ds.forward(req)
+			if err != nil {
+				Log.Error("forward mitm'd h2 request", "host", host, "error", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			h := w.Header()
+			for k, v := range resp.Header {
+				h[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			if _, err := io.Copy(w, resp.Body); err != nil {
+				Log.Error("write mitm'd h2 response", "host", host, "error", err)
+			}
+			_ = resp.Body.Close()
+		}),
+	})
+}
+
+// forward captures r, replays it against the primary backend
+// (returning its response for the caller to send on), and
+// asynchronously replays it against the secondary backend, comparing
+// the two responses via CompareResponses.
+func (ds *dualServer) forward(r *http.Request) (*http.Response, error) {
+	// TODO(tgulacsi): save just the headers and return a TeeWriter body.
+	readReq, saveResp, diffKey, reqBody, reqKey, sessID, err := ds.saveRequestResponse(r)
+	if err != nil {
+		return nil, fmt.Errorf("saving request: %v", err)
+	}
+	ds.log.record(&Meta{req: r, t: time.Now(), sess: int64(sessID), from: r.RemoteAddr,
+		body: reqBody, bodyPath: reqKey})
+
+	if r, err = readReq(); err != nil {
+		return nil, fmt.Errorf("reading request: %v", err)
+	}
 	r.RequestURI = ""
+	primaryStart := time.Now()
 	resp1, err := ds.primary.Do(r)
 	if err != nil {
-		Log.Error("call primary", "error", err)
-		http.Error(w, fmt.Sprintf("call primary: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("call primary: %v", err)
+	}
+	primaryTook := time.Since(primaryStart)
+
+	// TODO(tgulacsi): save just the headers and return a TeeWriter body.
+	resp, body1, resp1Key, err := saveResp(resp1, 1)
+	if err != nil {
+		Log.Error("save response1", "error", err)
+		resp, body1 = resp1, nil
 	}
-	go func(sc int) {
+	status1, header1 := resp.StatusCode, resp.Header
+	ds.log.record(&Meta{resp: resp, t: time.Now(), sess: int64(sessID), took: primaryTook,
+		body: body1, bodyPath: resp1Key})
+
+	go func() {
 		if r, err = readReq(); err != nil {
 			Log.Error("error reading request (2.)", "error", err)
 			return
 		}
+		secondaryStart := time.Now()
 		resp2, err := ds.secondary.Do(r)
 		if err != nil {
 			Log.Error("call secondary", "error", err)
 			return
 		}
-		if _, err = saveResp(resp2, 2); err != nil {
+		secondaryTook := time.Since(secondaryStart)
+		resp2, body2, resp2Key, err := saveResp(resp2, 2)
+		if err != nil {
 			Log.Error("save secondary response", "error", err)
 			return
 		}
+		ds.log.record(&Meta{resp: resp2, t: time.Now(), sess: int64(sessID), took: secondaryTook,
+			body: body2, bodyPath: resp2Key})
 
-		if resp2.StatusCode != sc {
-			Log.Warn("status code mismatch", "primary", sc, "secondary", resp2.StatusCode)
+		if resp2.StatusCode != status1 {
+			Log.Warn("status code mismatch", "primary", status1, "secondary", resp2.StatusCode)
 		}
-	}(resp1.StatusCode)
 
-	// TODO(tgulacsi): save just the headers and return a TeeWriter body.
-	resp, err := saveResp(resp1, 1)
-	if err != nil {
-		Log.Error("save response1", "error", err)
-		resp = resp1
-	}
+		report := CompareResponses(status1, header1, body1, resp2.StatusCode, resp2.Header, body2, ds.diffOpts)
+		if err := ds.store.Put(context.Background(), diffKey, jsonReader(report)); err != nil {
+			Log.Error("save diff report", "error", err)
+			return
+		}
+		Log.Info("diff summary", "added", report.Added(), "removed", report.Removed(), "changed", report.Changed(), "bodyEqual", report.BodyEqual)
+	}()
 
-	// answer
-	h := w.Header()
-	for k, v := range resp.Header {
-		h[k] = v
-	}
-	w.WriteHeader(resp.StatusCode)
+	return resp, nil
+}
 
-	if _, err = io.Copy(w, resp.Body); err != nil {
-		Log.Error("writing response", "error", err)
+func jsonReader(v interface{}) io.Reader {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return bytes.NewReader([]byte(fmt.Sprintf(`{"error":%q}`, err.Error())))
 	}
-
+	return bytes.NewReader(b)
 }
 
-func (ds *dualServer) saveRequestResponse(r *http.Request) (func() (*http.Request, error), func(*http.Response, int) (*http.Response, error), error) {
+func (ds *dualServer) saveRequestResponse(r *http.Request) (func() (*http.Request, error), func(*http.Response, int) (*http.Response, []byte, string, error), string, []byte, string, uint32, error) {
 	id := ds.nextID()
-	base := filepath.Join(ds.dir, fmt.Sprintf("%09d", id))
-	saveReq, err := saveRequest(base+".0", r)
+	t := time.Now()
+	reqKey := keyLayout(t, id, "req")
+	saveReq, reqBody, err := saveRequest(ds.store, reqKey, r)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", nil, reqKey, id, err
 	}
-	return saveReq, func(resp *http.Response, n int) (*http.Response, error) {
+	saveResp := func(resp *http.Response, n int) (*http.Response, []byte, string, error) {
 		if n <= 0 {
 			panic("n must be bigger than zero!")
 		}
-		return saveResponse(base+fmt.Sprintf(".%d", n), resp)
-	}, nil
+		key := keyLayout(t, id, fmt.Sprintf("resp%d", n))
+		resp, body, err := saveResponse(ds.store, key, resp)
+		return resp, body, key, err
+	}
+	return saveReq, saveResp, keyLayout(t, id, "diff.json"), reqBody, reqKey, id, nil
 }
 
-func saveResponse(dest string, resp *http.Response) (*http.Response, error) {
-	fh, err := os.Create(dest)
+func saveResponse(store Store, key string, resp *http.Response) (*http.Response, []byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return resp, err
+		return resp, nil, err
+	}
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if IsGRPC(resp.Header.Get("Content-Type")) {
+		if err := saveGRPCFrames(store, key, body, resp.Trailer); err != nil {
+			Log.Error("save grpc frames", "key", key, "error", err)
+		}
 	}
-	if err = resp.Write(fh); err != nil {
-		_ = fh.Close()
-		return nil, err
+
+	w := store.NewWriter(key)
+	if err := resp.Write(w); err != nil {
+		_ = w.Close()
+		return resp, body, err
 	}
-	if _, err = fh.Seek(0, 0); err != nil {
-		_ = fh.Close()
-		return nil, err
+	if err := w.Close(); err != nil {
+		return resp, body, err
 	}
-	resp, err = http.ReadResponse(bufio.NewReader(fh), nil)
+	rc, err := store.Get(key)
 	if err != nil {
-		_ = fh.Close()
-		return resp, err
+		return resp, body, err
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(rc), nil)
+	if err != nil {
+		_ = rc.Close()
+		return resp, body, err
 	}
 	resp.Body = struct {
 		io.Reader
 		io.Closer
-	}{resp.Body, multiCloser{[]io.Closer{resp.Body, fh}}}
-	return resp, nil
+	}{resp.Body, multiCloser{[]io.Closer{resp.Body, rc}}}
+	return resp, body, nil
 }
 
-func saveRequest(dest string, r *http.Request) (func() (*http.Request, error), error) {
-	fh, err := os.Create(dest)
+func saveRequest(store Store, key string, r *http.Request) (func() (*http.Request, error), []byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if err = r.Write(fh); err != nil {
-		_ = fh.Close()
-		return nil, err
+	_ = r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if IsGRPC(r.Header.Get("Content-Type")) {
+		if err := saveGRPCFrames(store, key, body, r.Trailer); err != nil {
+			Log.Error("save grpc frames", "key", key, "error", err)
+		}
+	}
+
+	w := store.NewWriter(key)
+	if err := r.Write(w); err != nil {
+		_ = w.Close()
+		return nil, body, err
 	}
-	if err = fh.Close(); err != nil {
-		return nil, err
+	if err := w.Close(); err != nil {
+		return nil, body, err
 	}
-	nm := fh.Name()
 	return func() (*http.Request, error) {
-		fh, err := os.Open(nm)
+		rc, err := store.Get(key)
 		if err != nil {
 			return nil, err
 		}
-		req, err := http.ReadRequest(bufio.NewReader(fh))
+		req, err := http.ReadRequest(bufio.NewReader(rc))
 		if err != nil {
+			_ = rc.Close()
 			return req, err
 		}
 		req.Body = struct {
 			io.Reader
 			io.Closer
-		}{req.Body, multiCloser{[]io.Closer{req.Body, fh}}}
+		}{req.Body, multiCloser{[]io.Closer{req.Body, rc}}}
 		return req, nil
-	}, nil
+	}, body, nil
 }
 
 func (ds *dualServer) nextID() uint32 {
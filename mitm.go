@@ -0,0 +1,217 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+// LoadOrCreateCA loads a root CA from certFile/keyFile (PEM), or
+// generates a fresh self-signed one and writes it there for reuse
+// across restarts if either file is missing.
+func LoadOrCreateCA(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" && keyFile != "" {
+		if ca, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			return ca, nil
+		}
+	}
+	ca, certPEM, keyPEM, err := generateCA()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certFile != "" {
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			return ca, err
+		}
+	}
+	if keyFile != "" {
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return ca, err
+		}
+	}
+	return ca, nil
+}
+
+func generateCA() (ca tls.Certificate, certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return ca, nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "testproxy MITM CA", Organization: []string{"testproxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return ca, nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	ca, err = tls.X509KeyPair(certPEM, keyPEM)
+	return ca, certPEM, keyPEM, err
+}
+
+// CertCache mints per-SNI leaf certificates signed by a root CA,
+// reusing goproxy's own CA-signing machinery (goproxy.TLSConfigFromCA),
+// and caches the resulting *tls.Config by SNI so repeat connections to
+// the same host skip re-signing.
+type CertCache struct {
+	configFor func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+
+	mu    sync.Mutex
+	bySNI map[string]*tls.Config
+}
+
+// NewCertCache builds a CertCache signing leaves with ca.
+func NewCertCache(ca tls.Certificate) *CertCache {
+	return &CertCache{
+		configFor: goproxy.TLSConfigFromCA(&ca),
+		bySNI:     make(map[string]*tls.Config),
+	}
+}
+
+// GetConfigForClient is a tls.Config.GetConfigForClient callback that
+// mints (or reuses) a leaf certificate for the incoming SNI.
+func (c *CertCache) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	sni := hello.ServerName
+	c.mu.Lock()
+	if cfg, ok := c.bySNI[sni]; ok {
+		c.mu.Unlock()
+		return cfg, nil
+	}
+	c.mu.Unlock()
+
+	cfg, err := c.configFor(sni, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Offer h2 so gRPC and other HTTP/2-only clients, which refuse to
+	// proceed past the handshake without ALPN negotiating it, still
+	// work when tunneled through this MITM'd CONNECT.
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	c.mu.Lock()
+	c.bySNI[sni] = cfg
+	c.mu.Unlock()
+	return cfg, nil
+}
+
+// HostFilter decides, per CONNECT target, whether the dualServer
+// should terminate TLS and inspect the traffic (MITM) or simply
+// tunnel the raw bytes through untouched. Entries are shell-style
+// glob patterns matched against "host" (no port); a leading "!"
+// makes the entry a deny (never intercept) rule. An empty filter
+// intercepts every host.
+type HostFilter struct {
+	allow []string
+	deny  []string
+}
+
+// NewHostFilter parses a comma separated -mitm-hosts list.
+func NewHostFilter(spec string) *HostFilter {
+	f := &HostFilter{}
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, "!") {
+			f.deny = append(f.deny, p[1:])
+		} else {
+			f.allow = append(f.allow, p)
+		}
+	}
+	return f
+}
+
+// ShouldIntercept reports whether host (without port) should be
+// MITM'd rather than tunneled untouched.
+func (f *HostFilter) ShouldIntercept(host string) bool {
+	for _, p := range f.deny {
+		if matchHost(p, host) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+// tunnel relays a CONNECT'd connection byte-for-byte between the
+// client and destHost, without terminating TLS; used for hosts the
+// HostFilter excludes from MITM.
+func (ds *dualServer) tunnel(w http.ResponseWriter, destHost string) {
+	destConn, err := net.DialTimeout("tcp", destHost, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		_ = destConn.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hj.Hijack()
+	if err != nil {
+		_ = destConn.Close()
+		Log.Error("hijack", "error", err)
+		return
+	}
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		Log.Error("write connection established", "error", err)
+		_ = destConn.Close()
+		_ = clientConn.Close()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(destConn, clientConn)
+		_ = destConn.Close()
+	}()
+	_, _ = io.Copy(clientConn, destConn)
+	_ = clientConn.Close()
+}
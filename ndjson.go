@@ -0,0 +1,131 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// DumpFormat selects how dualServer's -format flag renders captured
+// Metas to the "log" file.
+type DumpFormat int
+
+const (
+	// FormatText is the original "Type/ReceivedAt/Session/From" plus
+	// raw header dump framing.
+	FormatText DumpFormat = iota
+	// FormatNDJSON writes one JSON object per line instead.
+	FormatNDJSON
+)
+
+// ParseDumpFormat maps the -format flag value to a DumpFormat.
+func ParseDumpFormat(s string) (DumpFormat, error) {
+	switch s {
+	case "", "text":
+		return FormatText, nil
+	case "ndjson":
+		return FormatNDJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q, want text or ndjson", s)
+	}
+}
+
+// maxInlineBody is the largest body ndjsonRecord.BodyInline will carry
+// verbatim; bigger bodies are referenced by BodyPath (and BodySHA256)
+// instead, since the dump under that key already has the full body.
+const maxInlineBody = 8 << 10 // 8KiB
+
+// ndjsonRecord is the JSON shape written per line in FormatNDJSON.
+type ndjsonRecord struct {
+	Type       string              `json:"type"` // "request" or "response"
+	ReceivedAt string              `json:"received_at"`
+	Session    int64               `json:"session"`
+	From       string              `json:"from,omitempty"`
+	Method     string              `json:"method,omitempty"`
+	URL        string              `json:"url,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	// TookMS is the elapsed time, in milliseconds, it took to get this
+	// request/response (0 where not tracked, e.g. the request record).
+	TookMS float64 `json:"took_ms,omitempty"`
+	// BodySHA256 and BodyPath are a reference to the full body already
+	// written to the store under the "req"/"resp1"/"resp2" dump this
+	// record accompanies.
+	BodySHA256 string `json:"body_sha256,omitempty"`
+	BodyPath   string `json:"body_path,omitempty"`
+	// BodyInline carries the body itself, base64 encoded, when it's
+	// small enough (see maxInlineBody) to be worth inlining.
+	BodyInline string `json:"body_inline,omitempty"`
+	// BodyDecoded is the body with its Content-Encoding undone and
+	// compacted - a normalized form alongside the raw one. It is set
+	// only for JSON bodies; other content types (form-urlencoded
+	// included) get no decoded form.
+	BodyDecoded json.RawMessage `json:"body_decoded,omitempty"`
+}
+
+func writeNDJSON(w io.Writer, rec *ndjsonRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+// decodeBody undoes contentEncoding and, if contentType is JSON,
+// compacts it, returning a normalized form suitable for
+// ndjsonRecord.BodyDecoded. It returns nil if body can't be
+// decompressed per contentEncoding or isn't actually JSON.
+func decodeBody(contentType, contentEncoding string, body []byte) json.RawMessage {
+	decoded, err := decompressBody(contentEncoding, body)
+	if err != nil || !isJSON(contentType) {
+		return nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, decoded); err != nil {
+		return nil
+	}
+	return json.RawMessage(compact.Bytes())
+}
+
+// decompressBody undoes contentEncoding ("gzip"/"deflate") on body,
+// returning it unchanged for any other (including empty) encoding.
+// Shared by CompareResponses, which must see decompressed JSON to
+// diff it.
+func decompressBody(contentEncoding string, body []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	case "deflate":
+		zr := flate.NewReader(bytes.NewReader(body))
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	default:
+		return body, nil
+	}
+}
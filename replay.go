@@ -0,0 +1,208 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ReplayOptions configures a replay run.
+type ReplayOptions struct {
+	// Concurrency is how many requests may be in flight at once.
+	Concurrency int
+	// RatePerSecond throttles how fast new requests are started; 0
+	// means unlimited (bounded only by Concurrency).
+	RatePerSecond float64
+	// PreserveTiming spaces request starts apart by the gap between
+	// their original "Date" request headers (best effort: requests
+	// without one fall back to the rate limit/concurrency cap alone).
+	PreserveTiming bool
+	DiffOpts       DiffOptions
+}
+
+// ReplayResult is the outcome of reissuing one captured request.
+type ReplayResult struct {
+	ReqKey string
+	Status int
+	Err    error
+	Diff   *DiffReport
+}
+
+// Replay walks store for "*.req" dumps written by dualServer, reissues
+// each against target (rewriting scheme/host), and compares the new
+// response against the "*.resp1" dump captured alongside it using the
+// same CompareResponses machinery the live diff path uses.
+func Replay(store Store, target string, opts ReplayOptions) ([]ReplayResult, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	var reqKeys []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ".req") {
+			reqKeys = append(reqKeys, k)
+		}
+	}
+	sort.Strings(reqKeys) // the "{yyyy}/{mm}/{dd}/{id}.req" layout sorts chronologically
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	var limiter *time.Ticker
+	if opts.RatePerSecond > 0 {
+		limiter = time.NewTicker(time.Duration(float64(time.Second) / opts.RatePerSecond))
+		defer limiter.Stop()
+	}
+
+	results := make([]ReplayResult, len(reqKeys))
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	var lastDate time.Time
+
+	for i, reqKey := range reqKeys {
+		if limiter != nil {
+			<-limiter.C
+		}
+		if opts.PreserveTiming {
+			if d, ok := requestDate(store, reqKey); ok {
+				if !lastDate.IsZero() {
+					if gap := d.Sub(lastDate); gap > 0 {
+						time.Sleep(gap)
+					}
+				}
+				lastDate = d
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, reqKey string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = replayOne(store, targetURL, reqKey, opts.DiffOpts)
+		}(i, reqKey)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func requestDate(store Store, reqKey string) (time.Time, bool) {
+	rc, err := store.Get(reqKey)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer rc.Close()
+	req, err := http.ReadRequest(bufio.NewReader(rc))
+	if err != nil {
+		return time.Time{}, false
+	}
+	d := req.Header.Get("Date")
+	if d == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(d)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func replayOne(store Store, target *url.URL, reqKey string, diffOpts DiffOptions) ReplayResult {
+	result := ReplayResult{ReqKey: reqKey}
+
+	rc, err := store.Get(reqKey)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req, err := http.ReadRequest(bufio.NewReader(rc))
+	if err != nil {
+		_ = rc.Close()
+		result.Err = err
+		return result
+	}
+	// http.ReadRequest only parses the header off rc; the body is
+	// streamed lazily from it afterwards, so rc must stay open (like
+	// saveRequest/saveResponse do with multiCloser) until req.Body is
+	// actually read and closed, which client.Do does for us below.
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{req.Body, multiCloser{[]io.Closer{req.Body, rc}}}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.Host = target.Host
+	req.RequestURI = ""
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	resp, body, err := saveResponse(store, strings.TrimSuffix(reqKey, ".req")+".replay.resp", resp)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Status = resp.StatusCode
+
+	respKey := strings.TrimSuffix(reqKey, ".req") + ".resp1"
+	origRC, err := store.Get(respKey)
+	if err != nil {
+		// no stored response to diff against (e.g. dir predates capture)
+		return result
+	}
+	origResp, err := http.ReadResponse(bufio.NewReader(origRC), nil)
+	if err != nil {
+		_ = origRC.Close()
+		result.Err = err
+		return result
+	}
+	// Same reasoning as req.Body above: origRC must outlive the header
+	// parse since origResp.Body still streams from it.
+	origResp.Body = struct {
+		io.Reader
+		io.Closer
+	}{origResp.Body, multiCloser{[]io.Closer{origResp.Body, origRC}}}
+	origBody, err := readAllAndClose(origResp.Body)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	report := CompareResponses(origResp.StatusCode, origResp.Header, origBody, resp.StatusCode, resp.Header, body, diffOpts)
+	result.Diff = report
+	_ = store.Put(context.Background(), strings.TrimSuffix(reqKey, ".req")+".replay.diff.json", jsonReader(report))
+	return result
+}
+
+func readAllAndClose(rc io.ReadCloser) ([]byte, error) {
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestReplayOneLargeBody captures a request/response pair whose bodies
+// exceed bufio's default 4096-byte buffer and replays it against a
+// server returning the same body, the same scenario that used to fail
+// with "read ...: file already closed" because replayOne closed the
+// store's reader right after http.ReadRequest/ReadResponse parsed the
+// header, before the (lazily streamed) body was ever read.
+func TestReplayOneLargeBody(t *testing.T) {
+	body := strings.Repeat("y", 64<<10)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://orig.example.com/", nil)
+	if _, _, err := saveRequest(store, "2020/01/02/1.req", req); err != nil {
+		t.Fatal(err)
+	}
+
+	origResp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if _, _, err := saveResponse(store, "2020/01/02/1.resp1", origResp); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := replayOne(store, target, "2020/01/02/1.req", DiffOptions{})
+	if result.Err != nil {
+		t.Fatalf("replayOne: %v", result.Err)
+	}
+	if result.Diff == nil {
+		t.Fatal("want a diff report, got nil")
+	}
+	if !result.Diff.BodyEqual {
+		t.Errorf("want identical bodies to compare equal, got a diff: %+v", result.Diff)
+	}
+}
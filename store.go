@@ -0,0 +1,65 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Store abstracts the durable backend the proxy writes captured
+// request/response dumps to, so dualServer can stream to local disk,
+// a remote object store, or a rolling archive without knowing which.
+type Store interface {
+	// Put writes all of r under key, blocking until the write is
+	// durable or an error occurs. Implementations may buffer in
+	// memory to compute e.g. a checksum before committing.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// NewWriter returns a writer streaming directly to key; the
+	// caller must Close it to flush and finalize the write.
+	NewWriter(key string) io.WriteCloser
+	// Get opens key for reading. The caller must Close it.
+	Get(key string) (io.ReadCloser, error)
+	// List returns the keys sharing the given prefix, sorted.
+	List(prefix string) ([]string, error)
+}
+
+// keyLayout renders the per-session key for a dump of the given kind
+// ("req" for the request, "resp1"/"resp2" for the primary/secondary
+// response, "diff.json" for the comparison report) as
+// "{yyyy}/{mm}/{dd}/{session}.{kind}", so dumps land in a directory
+// tree that is easy to browse or lifecycle-expire on a remote store.
+func keyLayout(t time.Time, session uint32, kind string) string {
+	return fmt.Sprintf("%04d/%02d/%02d/%09d.%s", t.Year(), t.Month(), t.Day(), session, kind)
+}
+
+// NewStore builds the Store named by kind. dir is used by the "file"
+// and "archive" kinds as the local root/archive path; uri is used by
+// the "s3" kind as the "bucket[/prefix]" destination.
+func NewStore(kind, dir, uri string) (Store, error) {
+	switch kind {
+	case "", "file":
+		return NewFileStore(dir)
+	case "s3":
+		return NewS3Store(uri)
+	case "archive":
+		return NewArchiveStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown store kind %q", kind)
+	}
+}
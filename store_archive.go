@@ -0,0 +1,213 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// archiveRollSize is the approximate uncompressed size at which
+// ArchiveStore rolls over to a fresh tar file, so a single archive
+// never grows unbounded on a long-running capture.
+const archiveRollSize = 256 << 20 // 256MiB
+
+// ArchiveStore appends dumps as entries of a rolling sequence of tar
+// files under dir ("00000001.tar", "00000002.tar", ...), instead of
+// one file per key. It trades random access (List/Get must scan the
+// archives) for far fewer inodes and easy off-host shipping of whole
+// archives.
+type ArchiveStore struct {
+	dir string
+
+	mu      sync.Mutex
+	seq     int
+	f       *os.File
+	tw      *tar.Writer
+	written int64
+}
+
+// NewArchiveStore returns an ArchiveStore rolling tar files under dir.
+func NewArchiveStore(dir string) (*ArchiveStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ArchiveStore{dir: dir}, nil
+}
+
+func (as *ArchiveStore) archivePath(seq int) string {
+	return filepath.Join(as.dir, fmt.Sprintf("%08d.tar", seq))
+}
+
+// rollLocked returns the tar.Writer for the current archive file,
+// opening or rolling to a new one as needed. Caller must hold as.mu.
+func (as *ArchiveStore) rollLocked() (*tar.Writer, error) {
+	if as.tw != nil && as.written < archiveRollSize {
+		return as.tw, nil
+	}
+	if as.tw != nil {
+		if err := as.tw.Close(); err != nil {
+			return nil, err
+		}
+		if err := as.f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	as.seq++
+	f, err := os.Create(as.archivePath(as.seq))
+	if err != nil {
+		return nil, err
+	}
+	as.f, as.tw, as.written = f, tar.NewWriter(f), 0
+	return as.tw, nil
+}
+
+func (as *ArchiveStore) Put(ctx context.Context, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	tw, err := as.rollLocked()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    key,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+	as.written += int64(len(b))
+	return tw.Flush()
+}
+
+// NewWriter buffers in memory and appends a tar entry on Close, since
+// a tar header needs the entry size up front.
+func (as *ArchiveStore) NewWriter(key string) io.WriteCloser {
+	return &archiveWriter{as: as, key: key}
+}
+
+func (as *ArchiveStore) Get(key string) (io.ReadCloser, error) {
+	archives, err := filepath.Glob(filepath.Join(as.dir, "*.tar"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(archives)
+	for _, path := range archives {
+		rc, err := openTarEntry(path, key)
+		if err != nil {
+			return nil, err
+		}
+		if rc != nil {
+			return rc, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func openTarEntry(archivePath, key string) (io.ReadCloser, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			_ = f.Close()
+			return nil, nil
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if hdr.Name != key {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+func (as *ArchiveStore) List(prefix string) ([]string, error) {
+	archives, err := filepath.Glob(filepath.Join(as.dir, "*.tar"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(archives)
+	var keys []string
+	for _, path := range archives {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			if prefix == "" || hasPrefixPath(hdr.Name, prefix) {
+				keys = append(keys, hdr.Name)
+			}
+		}
+		_ = f.Close()
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func hasPrefixPath(name, prefix string) bool {
+	return len(name) >= len(prefix) && name[:len(prefix)] == prefix
+}
+
+type archiveWriter struct {
+	as  *ArchiveStore
+	key string
+	buf bytes.Buffer
+}
+
+func (w *archiveWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *archiveWriter) Close() error {
+	return w.as.Put(context.Background(), w.key, &w.buf)
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// FileStore is the original local-filesystem Store: every key is a
+// relative path under dir, created (with its parent directories) on
+// first write.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a Store rooted at dir, creating it if missing.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (fs *FileStore) path(key string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(key))
+}
+
+func (fs *FileStore) Put(ctx context.Context, key string, r io.Reader) error {
+	w := fs.NewWriter(key)
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (fs *FileStore) NewWriter(key string) io.WriteCloser {
+	return &fileWriter{store: fs, key: key}
+}
+
+func (fs *FileStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(fs.path(key))
+}
+
+func (fs *FileStore) List(prefix string) ([]string, error) {
+	var keys []string
+	root := fs.path(prefix)
+	err := filepath.Walk(fs.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(fs.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if prefix == "" || p == root || strings.HasPrefix(p, root) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// fileWriter lazily creates its backing file (and parent directories)
+// on the first Write, mirroring the old FileStream behavior.
+type fileWriter struct {
+	store *FileStore
+	key   string
+	f     *os.File
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	if w.f == nil {
+		p := w.store.path(w.key)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return 0, err
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			return 0, err
+		}
+		w.f = f
+	}
+	return w.f.Write(b)
+}
+
+func (w *fileWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	return w.f.Close()
+}
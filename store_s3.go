@@ -0,0 +1,124 @@
+// Copyright 2015 Tamás Gulácsi
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// S3Store writes dumps straight to an S3-compatible object store,
+// keyed by the same "{yyyy}/{mm}/{dd}/{session}.{kind}" layout the
+// FileStore uses, under bucket/prefix.
+type S3Store struct {
+	bucket, prefix string
+	svc            *s3.S3
+}
+
+// NewS3Store builds an S3Store for uri, which is "bucket" or
+// "bucket/prefix". Credentials and endpoint come from the usual AWS
+// environment/config (so S3-compatible stores like Minio or Ceph work
+// by pointing AWS_* env vars or ~/.aws/config at them).
+func NewS3Store(uri string) (*S3Store, error) {
+	bucket, prefix := uri, ""
+	if i := strings.IndexByte(uri, '/'); i >= 0 {
+		bucket, prefix = uri[:i], uri[i+1:]
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 store needs a bucket name, got %q", uri)
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{bucket: bucket, prefix: prefix, svc: s3.New(sess)}, nil
+}
+
+func (s *S3Store) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(b),
+	})
+	return err
+}
+
+// NewWriter buffers in memory and uploads on Close, since S3 has no
+// append API; callers that need true zero-disk streaming for very
+// large payloads should use the multipart upload manager instead.
+func (s *S3Store) NewWriter(key string) io.WriteCloser {
+	return &s3Writer{s: s, key: key}
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix+"/"))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+type s3Writer struct {
+	s   *S3Store
+	key string
+	buf bytes.Buffer
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *s3Writer) Close() error {
+	return w.s.Put(context.Background(), w.key, &w.buf)
+}